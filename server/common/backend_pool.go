@@ -0,0 +1,148 @@
+package common
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mickael-kerjean/filestash/server/common/pacer"
+)
+
+// BackendPoolConfig tells a BackendPool how to dial and release the handles
+// it manages, and how to classify a failure as worth retrying.
+type BackendPoolConfig[T any] struct {
+	// Dial creates a brand new handle (a dialled SMB session, an FTP client, ...).
+	Dial func() (T, error)
+	// Close tears one down. Called on eviction and whenever a borrowed
+	// handle comes back broken.
+	Close func(T)
+	// IdleTimeout is how long a handle can sit unused before it's closed.
+	// Defaults to 30s.
+	IdleTimeout time.Duration
+	// MaxIdle caps how many handles are kept around between uses. Extra
+	// returns are closed instead of pooled. Defaults to 4.
+	MaxIdle int
+	// ShouldRetry decides whether an error justifies re-dialling and
+	// retrying the operation that produced it.
+	ShouldRetry pacer.ShouldRetry
+}
+
+// BackendPool is the generic connection-pool + pacer combination that
+// plg_backend_samba and plg_backend_ftp_only used to hand-roll on top of
+// AppCache: a set of live handles per remote, idle eviction, and
+// exponential-backoff retries on transient errors. At most MaxIdle handles
+// are kept idle between uses; the number of handles borrowed at once is not
+// capped, since Get dials a new one whenever none is idle. Get/Put let Ls/Cat/Save
+// borrow a handle for the length of one call instead of serializing every
+// operation on a single shared connection.
+type BackendPool[T any] struct {
+	mu     sync.Mutex
+	config BackendPoolConfig[T]
+	idle   []pooledHandle[T]
+	pacer  *pacer.Pacer
+	closed bool
+	stop   chan struct{}
+}
+
+type pooledHandle[T any] struct {
+	handle   T
+	lastUsed time.Time
+}
+
+// NewBackendPool starts the idle-reaper goroutine and returns a ready pool.
+// Close it via Close() when the remote is evicted from its owning cache.
+func NewBackendPool[T any](config BackendPoolConfig[T]) *BackendPool[T] {
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = 30 * time.Second
+	}
+	if config.MaxIdle <= 0 {
+		config.MaxIdle = 4
+	}
+	p := &BackendPool[T]{
+		config: config,
+		pacer:  pacer.New(100*time.Millisecond, 2*time.Second, 2, config.ShouldRetry),
+		stop:   make(chan struct{}),
+	}
+	go p.reap()
+	return p
+}
+
+// Get borrows a handle from the pool, dialling a new one if none is idle.
+func (p *BackendPool[T]) Get() (T, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		h := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return h.handle, nil
+	}
+	p.mu.Unlock()
+	return p.config.Dial()
+}
+
+// Put returns a handle to the pool. broken handles (ones that just failed
+// with a transient error) are closed instead of recycled, same as handles
+// returned once the pool already holds MaxIdle of them or has been closed.
+func (p *BackendPool[T]) Put(handle T, broken bool) {
+	if broken {
+		p.config.Close(handle)
+		return
+	}
+	p.mu.Lock()
+	if p.closed || len(p.idle) >= p.config.MaxIdle {
+		p.mu.Unlock()
+		p.config.Close(handle)
+		return
+	}
+	p.idle = append(p.idle, pooledHandle[T]{handle: handle, lastUsed: time.Now()})
+	p.mu.Unlock()
+}
+
+// Retry runs fn, retrying with backoff while config.ShouldRetry(err) holds.
+// fn is expected to Get/Put its own handle so a retry can borrow a freshly
+// dialled one if the previous attempt left its handle broken.
+func (p *BackendPool[T]) Retry(fn func() error) error {
+	return p.pacer.Call(fn)
+}
+
+// Close tears down every idle handle and stops the reaper. Handles that are
+// currently borrowed are closed by their holder's next Put instead, since
+// the pool is marked closed.
+func (p *BackendPool[T]) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.stop)
+	for _, h := range idle {
+		p.config.Close(h.handle)
+	}
+}
+
+func (p *BackendPool[T]) reap() {
+	t := time.NewTicker(p.config.IdleTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.mu.Lock()
+			fresh := p.idle[:0]
+			for _, h := range p.idle {
+				if time.Since(h.lastUsed) > p.config.IdleTimeout {
+					p.config.Close(h.handle)
+					continue
+				}
+				fresh = append(fresh, h)
+			}
+			p.idle = fresh
+			p.mu.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
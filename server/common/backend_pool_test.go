@@ -0,0 +1,152 @@
+package common
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeHandle struct{ id int }
+
+func newFakePool(t *testing.T, config BackendPoolConfig[*fakeHandle]) (*BackendPool[*fakeHandle], *int32Counter) {
+	t.Helper()
+	closed := &int32Counter{}
+	dialed := 0
+	config.Dial = func() (*fakeHandle, error) {
+		dialed++
+		return &fakeHandle{id: dialed}, nil
+	}
+	config.Close = func(h *fakeHandle) { closed.inc() }
+	return NewBackendPool[*fakeHandle](config), closed
+}
+
+type int32Counter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *int32Counter) inc() {
+	c.mu.Lock()
+	c.n++
+	c.mu.Unlock()
+}
+
+func (c *int32Counter) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func TestBackendPoolReusesReturnedHandle(t *testing.T) {
+	pool, _ := newFakePool(t, BackendPoolConfig[*fakeHandle]{})
+	defer pool.Close()
+
+	h1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	pool.Put(h1, false)
+
+	h2, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if h1 != h2 {
+		t.Fatalf("expected the returned handle to be reused, got a new one")
+	}
+}
+
+func TestBackendPoolClosesBrokenHandles(t *testing.T) {
+	pool, closed := newFakePool(t, BackendPoolConfig[*fakeHandle]{})
+	defer pool.Close()
+
+	h1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	pool.Put(h1, true)
+
+	if closed.get() != 1 {
+		t.Fatalf("expected the broken handle to be closed, got %d closes", closed.get())
+	}
+
+	h2, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if h1 == h2 {
+		t.Fatalf("expected a fresh handle, got the broken one back")
+	}
+}
+
+func TestBackendPoolEnforcesMaxIdle(t *testing.T) {
+	pool, closed := newFakePool(t, BackendPoolConfig[*fakeHandle]{MaxIdle: 1})
+	defer pool.Close()
+
+	h1, _ := pool.Get()
+	h2, _ := pool.Get()
+	pool.Put(h1, false)
+	pool.Put(h2, false)
+
+	if closed.get() != 1 {
+		t.Fatalf("expected the handle past MaxIdle to be closed, got %d closes", closed.get())
+	}
+}
+
+func TestBackendPoolEvictsIdleHandles(t *testing.T) {
+	pool, closed := newFakePool(t, BackendPoolConfig[*fakeHandle]{IdleTimeout: 20 * time.Millisecond})
+	defer pool.Close()
+
+	h, _ := pool.Get()
+	pool.Put(h, false)
+
+	time.Sleep(100 * time.Millisecond)
+
+	if closed.get() != 1 {
+		t.Fatalf("expected the idle handle to have been reaped, got %d closes", closed.get())
+	}
+}
+
+func TestBackendPoolRetryStopsOnNonRetriableError(t *testing.T) {
+	pool, _ := newFakePool(t, BackendPoolConfig[*fakeHandle]{
+		ShouldRetry: func(err error) bool { return false },
+	})
+	defer pool.Close()
+
+	calls := 0
+	err := pool.Retry(func() error {
+		calls++
+		return errors.New("permanent")
+	})
+	if err == nil {
+		t.Fatalf("expected the error to surface")
+	}
+	if calls != 1 {
+		t.Fatalf("expected exactly one attempt, got %d", calls)
+	}
+}
+
+func TestBackendPoolRetryRetriesTransientErrors(t *testing.T) {
+	pool, _ := newFakePool(t, BackendPoolConfig[*fakeHandle]{
+		ShouldRetry: func(err error) bool { return err.Error() == "transient" },
+	})
+	pool.pacer.Min = time.Millisecond
+	pool.pacer.Max = 2 * time.Millisecond
+	defer pool.Close()
+
+	calls := 0
+	err := pool.Retry(func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected eventual success, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+}
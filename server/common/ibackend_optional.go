@@ -0,0 +1,27 @@
+package common
+
+import (
+	"io"
+	"os"
+)
+
+// BackendStater is implemented by backends that can stat a single path
+// directly instead of forcing callers to Ls the parent directory and filter
+// the result, which gets expensive on a directory with thousands of entries.
+type BackendStater interface {
+	Stat(path string) (os.FileInfo, error)
+}
+
+// BackendRangeCater is implemented by backends that can serve a byte range
+// of a file without transferring it in full, so the HTTP handler can
+// satisfy Range requests (video seek, thumbnailing, ...) directly instead of
+// downloading the whole file first.
+type BackendRangeCater interface {
+	CatRange(path string, offset, length int64) (io.ReadCloser, error)
+}
+
+// BackendChmoder is implemented by backends that can change a path's
+// permissions, letting the file-manager UI toggle read-only.
+type BackendChmoder interface {
+	Chmod(path string, mode os.FileMode) error
+}
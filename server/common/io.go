@@ -0,0 +1,16 @@
+package common
+
+import "io"
+
+// LimitReadCloser reads at most n bytes from r and closes via closer when
+// done. It's how backends implement BackendRangeCater.CatRange on top of a
+// regular file handle: limit the reader, keep the handle's own Close (which
+// for pooled backends also returns the borrowed connection to its pool).
+func LimitReadCloser(r io.Reader, closer io.Closer, n int64) io.ReadCloser {
+	return &limitReadCloser{io.LimitReader(r, n), closer}
+}
+
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
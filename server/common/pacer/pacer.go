@@ -0,0 +1,56 @@
+// Package pacer implements the exponential-backoff-with-jitter retry loop
+// shared by backends that talk to flaky remotes (SMB shares, FTP servers, ...).
+// It's deliberately tiny: a Pacer doesn't know anything about the operation
+// it retries, it just decides whether to try again and how long to wait.
+package pacer
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ShouldRetry decides whether an error returned by the retried operation is
+// worth a retry (a dropped connection) as opposed to a terminal one (a
+// permission error, a missing file, ...).
+type ShouldRetry func(err error) bool
+
+// Pacer calls a function, retrying with exponential backoff and jitter for
+// as long as ShouldRetry keeps saying yes, up to MaxRetry retries
+// (MaxRetry+1 attempts in all).
+type Pacer struct {
+	Min         time.Duration
+	Max         time.Duration
+	Decay       float64
+	MaxRetry    int
+	ShouldRetry ShouldRetry
+}
+
+// New builds a Pacer with the given backoff bounds. A nil shouldRetry means
+// nothing is ever retried.
+func New(min, max time.Duration, decay float64, shouldRetry ShouldRetry) *Pacer {
+	return &Pacer{
+		Min:         min,
+		Max:         max,
+		Decay:       decay,
+		MaxRetry:    5,
+		ShouldRetry: shouldRetry,
+	}
+}
+
+// Call runs fn, retrying it while p.ShouldRetry(err) holds.
+func (p *Pacer) Call(fn func() error) error {
+	delay := p.Min
+	var err error
+	for attempt := 0; attempt <= p.MaxRetry; attempt++ {
+		err = fn()
+		if err == nil || p.ShouldRetry == nil || !p.ShouldRetry(err) {
+			return err
+		}
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2+1))))
+		delay = time.Duration(float64(delay) * p.Decay)
+		if delay > p.Max {
+			delay = p.Max
+		}
+	}
+	return err
+}
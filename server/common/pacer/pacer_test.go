@@ -0,0 +1,71 @@
+package pacer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPacerReturnsImmediatelyOnSuccess(t *testing.T) {
+	p := New(time.Millisecond, 2*time.Millisecond, 2, func(err error) bool { return true })
+	calls := 0
+	err := p.Call(func() error {
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected exactly one attempt, got %d", calls)
+	}
+}
+
+func TestPacerDoesNotRetryWithoutShouldRetry(t *testing.T) {
+	p := New(time.Millisecond, 2*time.Millisecond, 2, nil)
+	calls := 0
+	err := p.Call(func() error {
+		calls++
+		return errors.New("boom")
+	})
+	if err == nil {
+		t.Fatalf("expected the error to surface")
+	}
+	if calls != 1 {
+		t.Fatalf("expected exactly one attempt, got %d", calls)
+	}
+}
+
+func TestPacerRetriesUpToMaxRetry(t *testing.T) {
+	p := New(time.Millisecond, 2*time.Millisecond, 2, func(err error) bool { return true })
+	p.MaxRetry = 3
+	calls := 0
+	err := p.Call(func() error {
+		calls++
+		return errors.New("always transient")
+	})
+	if err == nil {
+		t.Fatalf("expected the last error to surface")
+	}
+	if calls != p.MaxRetry+1 {
+		t.Fatalf("expected %d attempts, got %d", p.MaxRetry+1, calls)
+	}
+}
+
+func TestPacerStopsRetryingOnceShouldRetrySaysNo(t *testing.T) {
+	p := New(time.Millisecond, 2*time.Millisecond, 2, func(err error) bool { return err.Error() == "transient" })
+	calls := 0
+	err := p.Call(func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("transient")
+		}
+		return errors.New("permanent")
+	})
+	if err == nil || err.Error() != "permanent" {
+		t.Fatalf("expected the permanent error to surface, got %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", calls)
+	}
+}
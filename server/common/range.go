@@ -0,0 +1,70 @@
+package common
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ParseRange parses a "bytes=start-end" HTTP Range header value against a
+// resource of the given size. ok is false when the header is empty,
+// malformed, covers more than one range, or starts at or past the end of
+// the resource (so always when size is 0), in which case the caller should
+// fall back to serving the resource in full.
+func ParseRange(header string, size int64) (offset int64, length int64, ok bool) {
+	if header == "" || strings.Contains(header, ",") || !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+	spec := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(spec) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(spec[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end := size - 1
+	if spec[1] != "" {
+		e, err := strconv.ParseInt(spec[1], 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		end = e
+	}
+	if end >= size {
+		end = size - 1
+	}
+	if end < start {
+		return 0, 0, false
+	}
+	return start, end - start + 1, true
+}
+
+// CatBackend is what an HTTP handler calls to serve path: it honours a
+// Range header by calling CatRange when backend advertises support via
+// BackendRangeCater and reports the file's size via BackendStater, falling
+// back to a plain Cat when either interface is missing, Stat fails, the
+// header is absent, or it doesn't parse. partial reports whether the
+// returned reader only covers part of the file, so the caller knows
+// whether to answer 200 or 206.
+func CatBackend(backend IBackend, path string, rangeHeader string) (reader io.ReadCloser, partial bool, err error) {
+	ranger, supportsRange := backend.(BackendRangeCater)
+	if !supportsRange || rangeHeader == "" {
+		reader, err = backend.Cat(path)
+		return reader, false, err
+	}
+
+	var size int64
+	if stater, ok := backend.(BackendStater); ok {
+		if info, statErr := stater.Stat(path); statErr == nil {
+			size = info.Size()
+		}
+	}
+	offset, length, ok := ParseRange(rangeHeader, size)
+	if !ok {
+		reader, err = backend.Cat(path)
+		return reader, false, err
+	}
+	reader, err = ranger.CatRange(path, offset, length)
+	return reader, true, err
+}
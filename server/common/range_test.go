@@ -0,0 +1,33 @@
+package common
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header     string
+		size       int64
+		wantOffset int64
+		wantLength int64
+		wantOk     bool
+	}{
+		{"bytes=0-99", 1000, 0, 100, true},
+		{"bytes=100-", 1000, 100, 900, true},
+		{"bytes=900-1200", 1000, 900, 100, true},
+		{"bytes=100-50", 1000, 0, 0, false},
+		{"", 1000, 0, 0, false},
+		{"bogus", 1000, 0, 0, false},
+		{"bytes=0-99,200-299", 1000, 0, 0, false},
+	}
+	for _, c := range cases {
+		offset, length, ok := ParseRange(c.header, c.size)
+		if ok != c.wantOk {
+			t.Fatalf("ParseRange(%q, %d) ok = %v, want %v", c.header, c.size, ok, c.wantOk)
+		}
+		if !ok {
+			continue
+		}
+		if offset != c.wantOffset || length != c.wantLength {
+			t.Fatalf("ParseRange(%q, %d) = (%d, %d), want (%d, %d)", c.header, c.size, offset, length, c.wantOffset, c.wantLength)
+		}
+	}
+}
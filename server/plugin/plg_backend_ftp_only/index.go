@@ -2,6 +2,8 @@ package plg_backend_ftp_only
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	. "github.com/mickael-kerjean/filestash/server/common"
 	//"github.com/secsy/goftp" <- FTP issue with microsoft FTP
@@ -17,7 +19,7 @@ import (
 var FtpCache AppCache
 
 type Ftp struct {
-	client *goftp.Client
+	pool *BackendPool[*goftp.Client]
 }
 
 func init() {
@@ -25,22 +27,24 @@ func init() {
 
 	FtpCache = NewAppCache(2, 1)
 	FtpCache.OnEvict(func(key string, value interface{}) {
-		c := value.(*Ftp)
-		c.Close()
+		pool := value.(*BackendPool[*goftp.Client])
+		pool.Close()
 	})
 }
 
 func (f Ftp) Init(params map[string]string, app *App) (IBackend, error) {
 	if c := FtpCache.Get(params); c != nil {
-		d := c.(*Ftp)
-		return d, nil
+		return &Ftp{c.(*BackendPool[*goftp.Client])}, nil
 	}
 	if params["hostname"] == "" {
 		params["hostname"] = "localhost"
 	}
-
 	if params["port"] == "" {
-		params["port"] = "21"
+		if params["ftps_mode"] == "implicit" {
+			params["port"] = "990"
+		} else {
+			params["port"] = "21"
+		}
 	}
 	if params["username"] == "" {
 		params["username"] = "anonymous"
@@ -48,33 +52,124 @@ func (f Ftp) Init(params map[string]string, app *App) (IBackend, error) {
 	if params["username"] == "anonymous" && params["password"] == "" {
 		params["password"] = "anonymous"
 	}
-	conn := 5
-	if params["conn"] != "" {
-		if i, err := strconv.Atoi(params["conn"]); err == nil && i > 0 {
-			conn = i
-		}
+
+	pool := NewBackendPool[*goftp.Client](BackendPoolConfig[*goftp.Client]{
+		Dial:        func() (*goftp.Client, error) { return dialFtp(params) },
+		Close:       func(c *goftp.Client) { c.Close() },
+		IdleTimeout: 30 * time.Second,
+		MaxIdle:     ftpMaxIdle(params),
+		ShouldRetry: isRetriableFtpErr,
+	})
+	client, err := pool.Get()
+	if err != nil {
+		pool.Close()
+		return nil, err
 	}
+	if _, err := client.ReadDir("/"); err != nil {
+		pool.Put(client, true)
+		pool.Close()
+		return nil, ErrAuthenticationFailed
+	}
+	pool.Put(client, false)
 
-	configWithoutTLS := goftp.Config{
+	backend := &Ftp{pool}
+	FtpCache.Set(params, pool)
+	return backend, nil
+}
+
+func ftpMaxIdle(params map[string]string) int {
+	if params["conn"] == "" {
+		return 5
+	}
+	if i, err := strconv.Atoi(params["conn"]); err == nil && i > 0 {
+		return i
+	}
+	return 5
+}
+
+// dialFtp connects and authenticates a single *goftp.Client, negotiating
+// FTPS per ftps_mode and falling back to plain FTP when the user opted into
+// that via "Disable FTPS" and the server doesn't speak AUTH TLS.
+func dialFtp(params map[string]string) (*goftp.Client, error) {
+	config := goftp.Config{
 		User:               params["username"],
 		Password:           params["password"],
-		ConnectionsPerHost: conn,
+		ConnectionsPerHost: 1,
 		Timeout:            10 * time.Second,
 	}
+	tlsConfig, tlsMode, err := ftpsConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		config.TLSConfig = tlsConfig
+		config.TLSMode = tlsMode
+	}
 
-	var backend *Ftp = nil
+	address := fmt.Sprintf("%s:%s", strings.TrimPrefix(params["hostname"], "ftp://"), params["port"])
+	client, err := goftp.DialConfig(config, address)
+	if tlsMode == goftp.TLSExplicit && params["disable_ftps"] == "true" {
+		if err == nil {
+			// probe with a command so a server that rejects AUTH TLS is
+			// detected here rather than on the first real operation.
+			if _, err = client.Getwd(); err != nil {
+				client.Close()
+			}
+		}
+		if err != nil {
+			// explicit FTPS negotiates AUTH TLS over the plain control channel,
+			// so falling back to a cleartext handshake is meaningful here - the
+			// user explicitly opted into that with "Disable FTPS". Implicit
+			// FTPS has no such fallback: the server is listening for TLS from
+			// the first byte, so a plain retry would just fail again.
+			config.TLSConfig = nil
+			client, err = goftp.DialConfig(config, address)
+		}
+	}
+	return client, err
+}
 
-	client, err := goftp.DialConfig(configWithoutTLS, fmt.Sprintf("%s:%s", strings.TrimPrefix(params["hostname"], "ftp://"), params["port"]))
-	if err != nil {
-		return backend, err
+// ftpsConfig builds the *tls.Config for the selected ftps_mode, or returns
+// a nil config when the user asked for plain FTP.
+func ftpsConfig(params map[string]string) (*tls.Config, goftp.TLSMode, error) {
+	var mode goftp.TLSMode
+	switch params["ftps_mode"] {
+	case "explicit":
+		mode = goftp.TLSExplicit
+	case "implicit":
+		mode = goftp.TLSImplicit
+	default:
+		return nil, 0, nil
 	}
-	if _, err := client.ReadDir("/"); err != nil {
-		client.Close()
-		return backend, ErrAuthenticationFailed
+	tlsConfig := &tls.Config{
+		ServerName:         strings.TrimPrefix(params["hostname"], "ftp://"),
+		InsecureSkipVerify: params["skip_verify"] == "true",
 	}
-	backend = &Ftp{client}
-	FtpCache.Set(params, backend)
-	return backend, nil
+	if params["ca_cert"] != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(params["ca_cert"])) {
+			return nil, 0, NewError("Invalid CA certificate", 400)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, mode, nil
+}
+
+// isRetriableFtpErr classifies the network errors worth re-dialling for: a
+// dropped control connection, a reset or a short read/write hitting EOF on
+// a socket the server has already torn down.
+func isRetriableFtpErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "use of closed network connection") ||
+		strings.Contains(msg, "broken pipe") ||
+		strings.Contains(msg, "connection reset by peer") ||
+		strings.Contains(msg, "i/o timeout")
 }
 
 func (f Ftp) LoginForm() Form {
@@ -104,7 +199,7 @@ func (f Ftp) LoginForm() Form {
 				Name:        "advanced",
 				Type:        "enable",
 				Placeholder: "Advanced",
-				Target:      []string{"ftp_path", "ftp_port", "ftp_conn", "ftp_disable_ftps"},
+				Target:      []string{"ftp_path", "ftp_port", "ftp_conn", "ftp_ftps_mode", "ftp_skip_verify", "ftp_ca_cert", "ftp_disable_ftps"},
 			},
 			FormElement{
 				Id:          "ftp_path",
@@ -122,47 +217,209 @@ func (f Ftp) LoginForm() Form {
 				Id:          "ftp_conn",
 				Name:        "conn",
 				Type:        "number",
-				Placeholder: "Number of connections",
+				Placeholder: "Number of pooled connections",
 			},
 			FormElement{
-				Id:          "ftp_conn",
-				Name:        "conn",
-				Type:        "number",
-				Placeholder: "Number of connections",
+				Id:          "ftp_ftps_mode",
+				Name:        "ftps_mode",
+				Type:        "select",
+				Placeholder: "FTPS",
+				Opts:        []string{"none", "explicit", "implicit"},
+			},
+			FormElement{
+				Id:          "ftp_skip_verify",
+				Name:        "skip_verify",
+				Type:        "checkbox",
+				Placeholder: "Skip certificate verification",
+			},
+			FormElement{
+				Id:          "ftp_ca_cert",
+				Name:        "ca_cert",
+				Type:        "textarea",
+				Placeholder: "CA Certificate (PEM)",
 			},
 			FormElement{
-				Id:   "ftp_disable_ftps",
-				Name: "Disable FTPS",
-				Type: "select",
-				Opts: []string{"DEBUG", "INFO", "WARNING", "ERROR"},
+				Id:          "ftp_disable_ftps",
+				Name:        "disable_ftps",
+				Type:        "checkbox",
+				Placeholder: "Disable FTPS",
 			},
 		},
 	}
 }
 
 func (f Ftp) Home() (string, error) {
-	return f.client.Getwd()
+	var home string
+	err := f.pool.Retry(func() error {
+		client, err := f.pool.Get()
+		if err != nil {
+			return err
+		}
+		home, err = client.Getwd()
+		f.pool.Put(client, isRetriableFtpErr(err))
+		return err
+	})
+	return home, err
 }
 
 func (f Ftp) Ls(path string) ([]os.FileInfo, error) {
-	return f.client.ReadDir(path)
+	var fs []os.FileInfo
+	err := f.pool.Retry(func() error {
+		client, err := f.pool.Get()
+		if err != nil {
+			return err
+		}
+		fs, err = client.ReadDir(path)
+		f.pool.Put(client, isRetriableFtpErr(err))
+		return err
+	})
+	return fs, err
+}
+
+// ftpReadCloser hands the borrowed client back to the pool once the caller
+// is done reading so a long download doesn't keep a connection checked out
+// of the pool for the rest of its idle lifetime.
+type ftpReadCloser struct {
+	*io.PipeReader
+	pool   *BackendPool[*goftp.Client]
+	client *goftp.Client
+	broken bool
+}
+
+func (r *ftpReadCloser) Close() error {
+	err := r.PipeReader.Close()
+	r.pool.Put(r.client, r.broken)
+	return err
 }
 
 func (f Ftp) Cat(path string) (io.ReadCloser, error) {
+	client, err := f.pool.Get()
+	if err != nil {
+		return nil, err
+	}
 	pr, pw := io.Pipe()
+	rc := &ftpReadCloser{pr, f.pool, client, false}
 	go func() {
 		// TODO: prevent closing
-		if err := f.client.Retrieve(path, pw); err != nil {
+		if err := client.Retrieve(path, pw); err != nil {
+			rc.broken = isRetriableFtpErr(err)
+			pr.CloseWithError(NewError("Problem", 409))
+		}
+		pw.Close()
+	}()
+	return rc, nil
+}
+
+func (f Ftp) Stat(path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := f.pool.Retry(func() error {
+		client, err := f.pool.Get()
+		if err != nil {
+			return err
+		}
+		info, err = client.Stat(path)
+		f.pool.Put(client, isRetriableFtpErr(err))
+		return err
+	})
+	return info, err
+}
+
+// Chmod shells out to SITE CHMOD: the FTP protocol itself has no notion of
+// permissions, but most servers (vsftpd, ProFTPD, pure-ftpd, ...) implement
+// this as a de-facto standard extension.
+func (f Ftp) Chmod(path string, mode os.FileMode) error {
+	return f.pool.Retry(func() error {
+		client, err := f.pool.Get()
+		if err != nil {
+			return err
+		}
+		raw, err := client.OpenRawConn()
+		if err != nil {
+			f.pool.Put(client, isRetriableFtpErr(err))
+			return err
+		}
+		_, _, err = raw.SendCommand("SITE CHMOD %o %s", mode.Perm(), path)
+		raw.Close()
+		f.pool.Put(client, isRetriableFtpErr(err))
+		return err
+	})
+}
+
+// errRangeSatisfied is returned by rangeWriter once it has written length
+// bytes, to make goftp's Retrieve abort the transfer early instead of
+// streaming the rest of the file to a writer that doesn't want it anymore.
+var errRangeSatisfied = errors.New("range satisfied")
+
+// rangeWriter adapts a plain io.Writer into a view of [offset, offset+length)
+// of whatever gets written to it. goftp's Client only exposes Retrieve(path,
+// io.Writer) - there's no REST/offset support on the public API - so a byte
+// range is served by still transferring from the start and discarding
+// everything before offset.
+type rangeWriter struct {
+	skip   int64
+	remain int64
+	w      io.Writer
+}
+
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	if rw.skip > 0 {
+		if int64(total) <= rw.skip {
+			rw.skip -= int64(total)
+			return total, nil
+		}
+		p = p[rw.skip:]
+		rw.skip = 0
+	}
+	if rw.remain <= 0 {
+		return total, errRangeSatisfied
+	}
+	if int64(len(p)) > rw.remain {
+		p = p[:rw.remain]
+	}
+	n, err := rw.w.Write(p)
+	rw.remain -= int64(n)
+	if err != nil {
+		return total, err
+	}
+	if rw.remain <= 0 {
+		return total, errRangeSatisfied
+	}
+	return total, nil
+}
+
+// CatRange serves a byte range of a file by streaming a regular Retrieve
+// through a rangeWriter that discards bytes before offset and stops the
+// transfer once length bytes have been delivered.
+func (f Ftp) CatRange(path string, offset, length int64) (io.ReadCloser, error) {
+	client, err := f.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	rc := &ftpReadCloser{pr, f.pool, client, false}
+	go func() {
+		rw := &rangeWriter{skip: offset, remain: length, w: pw}
+		if err := client.Retrieve(path, rw); err != nil && err != errRangeSatisfied {
+			rc.broken = isRetriableFtpErr(err)
 			pr.CloseWithError(NewError("Problem", 409))
+			return
 		}
 		pw.Close()
 	}()
-	return pr, nil
+	return rc, nil
 }
 
 func (f Ftp) Mkdir(path string) error {
-	_, err := f.client.Mkdir(path)
-	return err
+	return f.pool.Retry(func() error {
+		client, err := f.pool.Get()
+		if err != nil {
+			return err
+		}
+		_, err = client.Mkdir(path)
+		f.pool.Put(client, isRetriableFtpErr(err))
+		return err
+	})
 }
 
 func (f Ftp) Rm(path string) error {
@@ -200,26 +457,65 @@ func (f Ftp) Rm(path string) error {
 				}
 			}
 		}
-		err = f.client.Rmdir(path)
-		return transformError(err)
+		return transformError(f.pool.Retry(func() error {
+			client, err := f.pool.Get()
+			if err != nil {
+				return err
+			}
+			err = client.Rmdir(path)
+			f.pool.Put(client, isRetriableFtpErr(err))
+			return err
+		}))
 	}
-	err := f.client.Delete(path)
-	return transformError(err)
+	return transformError(f.pool.Retry(func() error {
+		client, err := f.pool.Get()
+		if err != nil {
+			return err
+		}
+		err = client.Delete(path)
+		f.pool.Put(client, isRetriableFtpErr(err))
+		return err
+	}))
 }
 
 func (f Ftp) Mv(from string, to string) error {
-	return f.client.Rename(from, to)
+	return f.pool.Retry(func() error {
+		client, err := f.pool.Get()
+		if err != nil {
+			return err
+		}
+		err = client.Rename(from, to)
+		f.pool.Put(client, isRetriableFtpErr(err))
+		return err
+	})
 }
 
 func (f Ftp) Touch(path string) error {
-	return f.client.Store(path, strings.NewReader(""))
+	return f.pool.Retry(func() error {
+		client, err := f.pool.Get()
+		if err != nil {
+			return err
+		}
+		err = client.Store(path, strings.NewReader(""))
+		f.pool.Put(client, isRetriableFtpErr(err))
+		return err
+	})
 }
 
 func (f Ftp) Save(path string, file io.Reader) error {
 	// TODO: prevent closing
-	return f.client.Store(path, file)
+	return f.pool.Retry(func() error {
+		client, err := f.pool.Get()
+		if err != nil {
+			return err
+		}
+		err = client.Store(path, file)
+		f.pool.Put(client, isRetriableFtpErr(err))
+		return err
+	})
 }
 
 func (f Ftp) Close() error {
-	return f.client.Close()
+	f.pool.Close()
+	return nil
 }
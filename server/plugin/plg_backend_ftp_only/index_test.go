@@ -0,0 +1,80 @@
+package plg_backend_ftp_only
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/prasad83/goftp"
+)
+
+func TestFtpMaxIdle(t *testing.T) {
+	cases := []struct {
+		params map[string]string
+		want   int
+	}{
+		{map[string]string{}, 5},
+		{map[string]string{"conn": ""}, 5},
+		{map[string]string{"conn": "bogus"}, 5},
+		{map[string]string{"conn": "0"}, 5},
+		{map[string]string{"conn": "-1"}, 5},
+		{map[string]string{"conn": "8"}, 8},
+	}
+	for _, c := range cases {
+		if got := ftpMaxIdle(c.params); got != c.want {
+			t.Errorf("ftpMaxIdle(%v) = %v, want %v", c.params, got, c.want)
+		}
+	}
+}
+
+func TestFtpsConfig(t *testing.T) {
+	if config, mode, err := ftpsConfig(map[string]string{}); config != nil || mode != 0 || err != nil {
+		t.Fatalf("plain FTP: got (%v, %v, %v), want (nil, 0, nil)", config, mode, err)
+	}
+
+	config, mode, err := ftpsConfig(map[string]string{"ftps_mode": "explicit", "hostname": "ftp://example.com"})
+	if err != nil {
+		t.Fatalf("explicit: unexpected error: %v", err)
+	}
+	if mode != goftp.TLSExplicit {
+		t.Fatalf("explicit: mode = %v, want TLSExplicit", mode)
+	}
+	if config.ServerName != "example.com" {
+		t.Fatalf("explicit: ServerName = %q, want %q", config.ServerName, "example.com")
+	}
+
+	config, mode, err = ftpsConfig(map[string]string{"ftps_mode": "implicit", "hostname": "example.com", "skip_verify": "true"})
+	if err != nil {
+		t.Fatalf("implicit: unexpected error: %v", err)
+	}
+	if mode != goftp.TLSImplicit {
+		t.Fatalf("implicit: mode = %v, want TLSImplicit", mode)
+	}
+	if !config.InsecureSkipVerify {
+		t.Fatalf("implicit: InsecureSkipVerify = false, want true")
+	}
+
+	if _, _, err := ftpsConfig(map[string]string{"ftps_mode": "explicit", "ca_cert": "not a pem"}); err == nil {
+		t.Fatalf("invalid ca_cert: expected an error")
+	}
+}
+
+func TestIsRetriableFtpErr(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{errors.New("use of closed network connection"), true},
+		{errors.New("write: broken pipe"), true},
+		{errors.New("read: connection reset by peer"), true},
+		{errors.New("dial: i/o timeout"), true},
+		{errors.New("530 Login incorrect"), false},
+	}
+	for _, c := range cases {
+		if got := isRetriableFtpErr(c.err); got != c.want {
+			t.Errorf("isRetriableFtpErr(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +13,8 @@ import (
 	. "github.com/mickael-kerjean/filestash/server/common"
 )
 
+const sambaDefaultIdleTimeout = 30 * time.Second
+
 var SambaCache AppCache
 
 func init() {
@@ -19,76 +22,39 @@ func init() {
 
 	SambaCache = NewAppCache(30)
 	SambaCache.OnEvict(func(key string, value interface{}) {
-		smb := value.(*Samba)
-		for key, _ := range smb.share {
-			if err := smb.share[key].Umount(); err != nil {
-				Log.Warning("samba: error unmounting share: %v", err)
-			}
-		}
-		if err := smb.session.Logoff(); err != nil {
-			Log.Warning("samba: error logging out: %v", err)
-		}
+		pool := value.(*BackendPool[*sambaConn])
+		pool.Close()
 	})
 }
 
+// Samba is a thin handle on top of a BackendPool[*sambaConn]: the pool (one
+// per distinct set of login params) owns the dialled sessions and their
+// mounted shares, Samba only borrows them for the duration of a single
+// operation.
 type Samba struct {
-	session *smb2.Session
-	share   map[string]*smb2.Share
+	params map[string]string
+	pool   *BackendPool[*sambaConn]
 }
 
 func (smb Samba) Init(params map[string]string, app *App) (IBackend, error) {
-	c := SambaCache.Get(params)
-	if c != nil {
-		return c.(*Samba), nil
-	}
-	conn, err := net.DialTimeout(
-		"tcp",
-		fmt.Sprintf(
-			"%s:%s",
-			params["host"],
-			func() string {
-				if params["port"] == "" {
-					return "445"
-				}
-				return params["port"]
-			}(),
-		),
-		10*time.Second,
-	)
-	if err != nil {
-		return nil, err
+	if c := SambaCache.Get(params); c != nil {
+		return &Samba{params, c.(*BackendPool[*sambaConn])}, nil
 	}
-
-	s := &Samba{nil, make(map[string]*smb2.Share, 0)}
-	s.session, err = (&smb2.Dialer{
-		Initiator: &smb2.NTLMInitiator{
-			User: func() string {
-				if params["username"] == "" {
-					return "Guest"
-				}
-				return params["username"]
-			}(),
-			Password: params["password"],
-			Domain:   params["domain"],
-		},
-	}).Dial(conn)
-	if err != nil {
-		return nil, err
-	}
-	names, err := s.session.ListSharenames()
+	pool := NewBackendPool[*sambaConn](BackendPoolConfig[*sambaConn]{
+		Dial:        func() (*sambaConn, error) { return dialSamba(params) },
+		Close:       func(c *sambaConn) { c.close() },
+		IdleTimeout: sambaIdleTimeout(params),
+		MaxIdle:     sambaMaxIdle(params),
+		ShouldRetry: isRetriableSambaErr,
+	})
+	conn, err := pool.Get()
 	if err != nil {
+		pool.Close()
 		return nil, err
 	}
-	for _, name := range names {
-		if strings.HasSuffix(name, "$") {
-			continue
-		}
-		if m, err := s.session.Mount(name); err == nil {
-			s.share[name] = m
-		}
-	}
-	SambaCache.Set(params, s)
-	return s, nil
+	pool.Put(conn, false)
+	SambaCache.Set(params, pool)
+	return &Samba{params, pool}, nil
 }
 
 func (smb Samba) LoginForm() Form {
@@ -118,7 +84,7 @@ func (smb Samba) LoginForm() Form {
 				Name:        "advanced",
 				Type:        "enable",
 				Placeholder: "Advanced",
-				Target:      []string{"samba_port", "samba_path", "samba_domain"},
+				Target:      []string{"samba_port", "samba_path", "samba_domain", "samba_spn", "samba_idle_timeout", "samba_case_insensitive", "samba_conn"},
 			},
 			{
 				Id:          "samba_path",
@@ -138,120 +104,442 @@ func (smb Samba) LoginForm() Form {
 				Type:        "text",
 				Placeholder: "Domain",
 			},
+			{
+				Id:          "samba_spn",
+				Name:        "spn",
+				Type:        "text",
+				Placeholder: "Service Principal Name - eg: cifs/fileserver.example.com",
+			},
+			{
+				Id:          "samba_idle_timeout",
+				Name:        "idle_timeout",
+				Type:        "number",
+				Placeholder: "Idle timeout in seconds - eg: 30",
+			},
+			{
+				Id:          "samba_case_insensitive",
+				Name:        "case_insensitive",
+				Type:        "checkbox",
+				Placeholder: "Case insensitive paths",
+			},
+			{
+				Id:          "samba_conn",
+				Name:        "conn",
+				Type:        "number",
+				Placeholder: "Number of pooled connections",
+			},
 		},
 	}
 }
 
 func (smb Samba) Ls(path string) ([]os.FileInfo, error) {
 	if path == "/" {
-		f := make([]os.FileInfo, 0)
-		for key, _ := range smb.share {
-			f = append(f, File{
-				FName: key,
-				FType: "directory",
-			})
-		}
-		return f, nil
-	}
-	share, path, err := smb.toSambaPath(path)
-	if err != nil {
-		return nil, err
-	}
-
-	dir, err := share.Open(path)
-	if err != nil {
-		return nil, fromSambaErr(err)
+		var f []os.FileInfo
+		err := smb.pool.Retry(func() error {
+			conn, rErr := smb.pool.Get()
+			if rErr != nil {
+				return rErr
+			}
+			names, rErr := conn.session.ListSharenames()
+			smb.pool.Put(conn, isRetriableSambaErr(rErr))
+			if rErr != nil {
+				return fromSambaErr(rErr)
+			}
+			f = make([]os.FileInfo, 0)
+			for _, name := range names {
+				if strings.HasSuffix(name, "$") {
+					continue
+				}
+				f = append(f, File{
+					FName: name,
+					FType: "directory",
+				})
+			}
+			return nil
+		})
+		return f, err
 	}
-	defer dir.Close()
 
-	fs, err := dir.Readdir(-1)
-	return fs, fromSambaErr(err)
+	var fs []os.FileInfo
+	err := smb.pool.Retry(func() error {
+		conn, rErr := smb.pool.Get()
+		if rErr != nil {
+			return rErr
+		}
+		share, p, rErr := smb.toSambaPath(conn, path)
+		if rErr != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(rErr))
+			return rErr
+		}
+		dir, rErr := share.Open(p)
+		if rErr != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(rErr))
+			return fromSambaErr(rErr)
+		}
+		defer dir.Close()
+		fs, rErr = dir.Readdir(-1)
+		smb.pool.Put(conn, isRetriableSambaErr(rErr))
+		return fromSambaErr(rErr)
+	})
+	return fs, err
 }
 
 func (smb Samba) Cat(path string) (io.ReadCloser, error) {
-	share, path, err := smb.toSambaPath(path)
-	if err != nil {
-		return nil, err
-	}
-
-	f, err := share.Open(path)
-	return f, fromSambaErr(err)
+	var file io.ReadCloser
+	err := smb.pool.Retry(func() error {
+		conn, rErr := smb.pool.Get()
+		if rErr != nil {
+			return rErr
+		}
+		share, p, rErr := smb.toSambaPath(conn, path)
+		if rErr != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(rErr))
+			return rErr
+		}
+		f, rErr := share.Open(p)
+		if rErr != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(rErr))
+			return fromSambaErr(rErr)
+		}
+		file = &sambaFile{f, smb.pool, conn}
+		return nil
+	})
+	return file, err
 }
 
 func (smb Samba) Mkdir(path string) error {
-	share, path, err := smb.toSambaPath(path)
-	if err != nil {
-		return err
-	}
-	return fromSambaErr(share.Mkdir(path, os.ModeDir))
+	return smb.pool.Retry(func() error {
+		conn, err := smb.pool.Get()
+		if err != nil {
+			return err
+		}
+		share, p, err := smb.toSambaPath(conn, path)
+		if err != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return err
+		}
+		err = share.Mkdir(p, os.ModeDir)
+		smb.pool.Put(conn, isRetriableSambaErr(err))
+		return fromSambaErr(err)
+	})
 }
 
 func (smb Samba) Rm(path string) error {
-	share, path, err := smb.toSambaPath(path)
-	if err != nil {
-		return err
-	}
-	return fromSambaErr(share.RemoveAll(path))
+	return smb.pool.Retry(func() error {
+		conn, err := smb.pool.Get()
+		if err != nil {
+			return err
+		}
+		share, p, err := smb.toSambaPath(conn, path)
+		if err != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return err
+		}
+		err = share.RemoveAll(p)
+		smb.pool.Put(conn, isRetriableSambaErr(err))
+		return fromSambaErr(err)
+	})
 }
 
 func (smb Samba) Mv(from, to string) error {
-	fromShare, fromPath, err := smb.toSambaPath(from)
-	if err != nil {
-		return err
-	}
-	toShare, toPath, err := smb.toSambaPath(to)
-	if err != nil {
-		return err
+	return smb.pool.Retry(func() error {
+		conn, err := smb.pool.Get()
+		if err != nil {
+			return err
+		}
+		fromShare, fromPath, err := smb.toSambaPath(conn, from)
+		if err != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return err
+		}
+		toShare, toPath, err := smb.toSambaPath(conn, to)
+		if err != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return err
+		}
+		if fromShare != toShare {
+			smb.pool.Put(conn, false)
+			return ErrNotImplemented
+		}
+		err = fromShare.Rename(fromPath, toPath)
+		smb.pool.Put(conn, isRetriableSambaErr(err))
+		return fromSambaErr(err)
+	})
+}
+
+func (smb Samba) Save(path string, content io.Reader) error {
+	return smb.pool.Retry(func() error {
+		conn, err := smb.pool.Get()
+		if err != nil {
+			return err
+		}
+		share, p, err := smb.toSambaPath(conn, path)
+		if err != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return err
+		}
+		f, err := share.Create(p)
+		if err != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return fromSambaErr(err)
+		}
+		if _, err = io.Copy(f, content); err != nil {
+			f.Close()
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return fromSambaErr(err)
+		}
+		err = f.Close()
+		smb.pool.Put(conn, isRetriableSambaErr(err))
+		return fromSambaErr(err)
+	})
+}
+
+func (smb Samba) Touch(path string) error {
+	return smb.pool.Retry(func() error {
+		conn, err := smb.pool.Get()
+		if err != nil {
+			return err
+		}
+		share, p, err := smb.toSambaPath(conn, path)
+		if err != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return err
+		}
+		f, err := share.Create(p)
+		if err != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return fromSambaErr(err)
+		}
+		err = f.Close()
+		smb.pool.Put(conn, isRetriableSambaErr(err))
+		return fromSambaErr(err)
+	})
+}
+
+func (smb Samba) Stat(path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := smb.pool.Retry(func() error {
+		conn, rErr := smb.pool.Get()
+		if rErr != nil {
+			return rErr
+		}
+		share, p, rErr := smb.toSambaPath(conn, path)
+		if rErr != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(rErr))
+			return rErr
+		}
+		info, rErr = share.Stat(p)
+		smb.pool.Put(conn, isRetriableSambaErr(rErr))
+		return fromSambaErr(rErr)
+	})
+	return info, err
+}
+
+func (smb Samba) Chmod(path string, mode os.FileMode) error {
+	return smb.pool.Retry(func() error {
+		conn, err := smb.pool.Get()
+		if err != nil {
+			return err
+		}
+		share, p, err := smb.toSambaPath(conn, path)
+		if err != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(err))
+			return err
+		}
+		err = share.Chmod(p, mode)
+		smb.pool.Put(conn, isRetriableSambaErr(err))
+		return fromSambaErr(err)
+	})
+}
+
+// CatRange serves a byte range of a file by opening it, seeking to offset
+// and capping the read at length, so the caller can satisfy an HTTP Range
+// request without downloading the whole file first.
+func (smb Samba) CatRange(path string, offset, length int64) (io.ReadCloser, error) {
+	var file io.ReadCloser
+	err := smb.pool.Retry(func() error {
+		conn, rErr := smb.pool.Get()
+		if rErr != nil {
+			return rErr
+		}
+		share, p, rErr := smb.toSambaPath(conn, path)
+		if rErr != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(rErr))
+			return rErr
+		}
+		f, rErr := share.OpenFile(p, os.O_RDONLY, 0)
+		if rErr != nil {
+			smb.pool.Put(conn, isRetriableSambaErr(rErr))
+			return fromSambaErr(rErr)
+		}
+		if _, rErr = f.Seek(offset, io.SeekStart); rErr != nil {
+			f.Close()
+			smb.pool.Put(conn, isRetriableSambaErr(rErr))
+			return fromSambaErr(rErr)
+		}
+		file = LimitReadCloser(f, &sambaFile{f, smb.pool, conn}, length)
+		return nil
+	})
+	return file, err
+}
+
+// sambaFile hands the borrowed connection back to the pool once the caller
+// is done streaming so the session can serve the next request instead of
+// sitting idle mid-download.
+type sambaFile struct {
+	*smb2.File
+	pool *BackendPool[*sambaConn]
+	conn *sambaConn
+}
+
+func (f *sambaFile) Close() error {
+	err := f.File.Close()
+	f.pool.Put(f.conn, isRetriableSambaErr(err))
+	return fromSambaErr(err)
+}
+
+// sambaConn is a single dialled session together with the shares that have
+// been mounted on it so far. Shares are mounted lazily: only once a path
+// under them is actually touched.
+type sambaConn struct {
+	session *smb2.Session
+	shares  map[string]*smb2.Share
+}
+
+func (c *sambaConn) close() {
+	for name, share := range c.shares {
+		if err := share.Umount(); err != nil {
+			Log.Warning("samba: error unmounting share %s: %v", name, err)
+		}
 	}
-	if fromShare != toShare {
-		return ErrNotImplemented
+	if err := c.session.Logoff(); err != nil {
+		Log.Warning("samba: error logging out: %v", err)
 	}
-	return fromSambaErr(fromShare.Rename(fromPath, toPath))
 }
 
-func (smb Samba) Save(path string, content io.Reader) error {
-	share, path, err := smb.toSambaPath(path)
-	if err != nil {
-		return err
+func sambaIdleTimeout(params map[string]string) time.Duration {
+	if params["idle_timeout"] == "" {
+		return sambaDefaultIdleTimeout
 	}
-	f, err := share.Create(path)
-	if err != nil {
-		return fromSambaErr(err)
+	seconds, err := strconv.Atoi(params["idle_timeout"])
+	if err != nil || seconds <= 0 {
+		return sambaDefaultIdleTimeout
 	}
-	if _, err = io.Copy(f, content); err != nil {
-		f.Close()
-		return fromSambaErr(err)
+	return time.Duration(seconds) * time.Second
+}
+
+func sambaMaxIdle(params map[string]string) int {
+	if params["conn"] == "" {
+		return 4
+	}
+	n, err := strconv.Atoi(params["conn"])
+	if err != nil || n <= 0 {
+		return 4
 	}
-	return f.Close()
+	return n
 }
 
-func (smb Samba) Touch(path string) error {
-	share, path, err := smb.toSambaPath(path)
+func dialSamba(params map[string]string) (*sambaConn, error) {
+	tcp, err := net.DialTimeout(
+		"tcp",
+		fmt.Sprintf(
+			"%s:%s",
+			params["host"],
+			func() string {
+				if params["port"] == "" {
+					return "445"
+				}
+				return params["port"]
+			}(),
+		),
+		10*time.Second,
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	f, err := share.Create(path)
+	session, err := (&smb2.Dialer{
+		Initiator: &smb2.NTLMInitiator{
+			User: func() string {
+				if params["username"] == "" {
+					return "Guest"
+				}
+				return params["username"]
+			}(),
+			Password:  params["password"],
+			Domain:    params["domain"],
+			TargetSPN: params["spn"],
+		},
+	}).Dial(tcp)
 	if err != nil {
-		return fromSambaErr(err)
+		tcp.Close()
+		return nil, err
 	}
-	return fromSambaErr(f.Close())
+	return &sambaConn{
+		session: session,
+		shares:  make(map[string]*smb2.Share),
+	}, nil
 }
 
-func (smb Samba) toSambaPath(path string) (*smb2.Share, string, error) {
-	p := strings.Split(strings.Trim(path, "/"), "/")
-	if len(p) == 0 {
+// toSambaPath resolves a virtual filestash path ("/share/some/file") down to
+// a smb2 share and an in-share path, mounting the share on demand the first
+// time it's requested on this connection.
+func (smb Samba) toSambaPath(conn *sambaConn, path string) (*smb2.Share, string, error) {
+	comp := strings.Split(strings.Trim(path, "/"), "/")
+	if len(comp) == 0 || comp[0] == "" {
 		return nil, "", ErrNotAllowed
 	}
-	sharename := p[0]
-	oPath := strings.TrimLeft(strings.Join(p[1:], "\\"), "\\")
-	if smb.share[sharename] == nil {
-		return nil, "", ErrNotFound
+	sharename := comp[0]
+	oPath := strings.TrimLeft(strings.Join(comp[1:], "\\"), "\\")
+
+	if share, ok := conn.shares[sharename]; ok {
+		return share, oPath, nil
+	}
+	if smb.params["case_insensitive"] == "true" {
+		for name, share := range conn.shares {
+			if strings.EqualFold(name, sharename) {
+				return share, oPath, nil
+			}
+		}
+		names, err := conn.session.ListSharenames()
+		if err != nil {
+			return nil, "", fromSambaErr(err)
+		}
+		for _, name := range names {
+			if strings.EqualFold(name, sharename) {
+				sharename = name
+				break
+			}
+		}
+	}
+	share, err := conn.session.Mount(sharename)
+	if err != nil {
+		return nil, "", fromSambaErr(err)
+	}
+	conn.shares[sharename] = share
+	return share, oPath, nil
+}
+
+// isRetriableSambaErr classifies the smb2/network errors worth re-dialling
+// and re-mounting for: a dropped pipe, a disconnected session or a short
+// read/write hitting EOF on a connection the server has already torn down.
+func isRetriableSambaErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
 	}
-	return smb.share[sharename], oPath, nil
+	msg := err.Error()
+	return strings.Contains(msg, "STATUS_PIPE_BROKEN") ||
+		strings.Contains(msg, "STATUS_CONNECTION_DISCONNECTED") ||
+		strings.Contains(msg, "broken pipe") ||
+		strings.Contains(msg, "use of closed network connection")
 }
 
 func fromSambaErr(err error) error {
 	switch {
+	case err == nil:
+		return nil
 	case os.IsPermission(err):
 		return ErrPermissionDenied
 	case os.IsNotExist(err):
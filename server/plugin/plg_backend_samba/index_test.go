@@ -0,0 +1,99 @@
+package plg_backend_samba
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+func TestSambaIdleTimeout(t *testing.T) {
+	cases := []struct {
+		params map[string]string
+		want   time.Duration
+	}{
+		{map[string]string{}, sambaDefaultIdleTimeout},
+		{map[string]string{"idle_timeout": ""}, sambaDefaultIdleTimeout},
+		{map[string]string{"idle_timeout": "bogus"}, sambaDefaultIdleTimeout},
+		{map[string]string{"idle_timeout": "0"}, sambaDefaultIdleTimeout},
+		{map[string]string{"idle_timeout": "-5"}, sambaDefaultIdleTimeout},
+		{map[string]string{"idle_timeout": "45"}, 45 * time.Second},
+	}
+	for _, c := range cases {
+		if got := sambaIdleTimeout(c.params); got != c.want {
+			t.Errorf("sambaIdleTimeout(%v) = %v, want %v", c.params, got, c.want)
+		}
+	}
+}
+
+func TestSambaMaxIdle(t *testing.T) {
+	cases := []struct {
+		params map[string]string
+		want   int
+	}{
+		{map[string]string{}, 4},
+		{map[string]string{"conn": ""}, 4},
+		{map[string]string{"conn": "bogus"}, 4},
+		{map[string]string{"conn": "0"}, 4},
+		{map[string]string{"conn": "-1"}, 4},
+		{map[string]string{"conn": "10"}, 10},
+	}
+	for _, c := range cases {
+		if got := sambaMaxIdle(c.params); got != c.want {
+			t.Errorf("sambaMaxIdle(%v) = %v, want %v", c.params, got, c.want)
+		}
+	}
+}
+
+func TestIsRetriableSambaErr(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{errors.New("STATUS_PIPE_BROKEN"), true},
+		{errors.New("STATUS_CONNECTION_DISCONNECTED"), true},
+		{errors.New("write: broken pipe"), true},
+		{errors.New("read: use of closed network connection"), true},
+		{errors.New("STATUS_ACCESS_DENIED"), false},
+	}
+	for _, c := range cases {
+		if got := isRetriableSambaErr(c.err); got != c.want {
+			t.Errorf("isRetriableSambaErr(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+// TestToSambaPathCaseInsensitiveLookup covers the part of toSambaPath that
+// doesn't need a live session: resolving a share that's already mounted on
+// the connection, exactly or case-insensitively depending on the
+// case_insensitive param.
+func TestToSambaPathCaseInsensitiveLookup(t *testing.T) {
+	conn := &sambaConn{shares: map[string]*smb2.Share{"Public": nil}}
+
+	smb := Samba{params: map[string]string{}}
+	if _, _, err := smb.toSambaPath(conn, "/Public/file.txt"); err != nil {
+		t.Fatalf("exact match: unexpected error: %v", err)
+	}
+
+	smb = Samba{params: map[string]string{"case_insensitive": "true"}}
+	_, oPath, err := smb.toSambaPath(conn, "/public/sub/file.txt")
+	if err != nil {
+		t.Fatalf("case-insensitive match: unexpected error: %v", err)
+	}
+	if oPath != `sub\file.txt` {
+		t.Fatalf("case-insensitive match: oPath = %q, want %q", oPath, `sub\file.txt`)
+	}
+}
+
+func TestToSambaPathRejectsEmptyPath(t *testing.T) {
+	smb := Samba{params: map[string]string{}}
+	conn := &sambaConn{shares: map[string]*smb2.Share{}}
+	if _, _, err := smb.toSambaPath(conn, "/"); err != ErrNotAllowed {
+		t.Fatalf("toSambaPath(\"/\") err = %v, want ErrNotAllowed", err)
+	}
+}